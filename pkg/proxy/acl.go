@@ -0,0 +1,221 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"strings"
+
+	"github.com/CodisLabs/codis/pkg/utils/errors"
+)
+
+// OpCategory is an ACL category bitmask, modeled on Redis 6's @read/@write/
+// ... command categories.  It's derived from an OpInfo's Flag and name by
+// categoryFor and filled in once, in opTable's init, rather than carried as
+// a literal in the table itself.
+type OpCategory uint32
+
+const (
+	CategoryRead OpCategory = 1 << iota
+	CategoryWrite
+	CategoryAdmin
+	CategoryDangerous
+	CategoryKeyspace
+	CategoryPubSub
+	CategoryScripting
+	CategoryFast
+	CategorySlow
+	CategoryConnection
+)
+
+var categoryNames = map[string]OpCategory{
+	"read":       CategoryRead,
+	"write":      CategoryWrite,
+	"admin":      CategoryAdmin,
+	"dangerous":  CategoryDangerous,
+	"keyspace":   CategoryKeyspace,
+	"pubsub":     CategoryPubSub,
+	"scripting":  CategoryScripting,
+	"fast":       CategoryFast,
+	"slow":       CategorySlow,
+	"connection": CategoryConnection,
+}
+
+var pubsubOps = map[string]bool{
+	"SUBSCRIBE": true, "UNSUBSCRIBE": true, "PSUBSCRIBE": true,
+	"PUNSUBSCRIBE": true, "PUBLISH": true, "PUBSUB": true,
+}
+
+var scriptingOps = map[string]bool{
+	"EVAL": true, "EVALSHA": true, "SCRIPT": true,
+}
+
+var connectionOps = map[string]bool{
+	"AUTH": true, "HELLO": true, "PING": true, "ECHO": true,
+	"SELECT": true, "CLIENT": true, "COMMAND": true,
+}
+
+var keyspaceOps = map[string]bool{
+	"DEL": true, "UNLINK": true, "EXPIRE": true, "EXPIREAT": true,
+	"PEXPIRE": true, "PEXPIREAT": true, "PERSIST": true, "RENAME": true,
+	"RENAMENX": true, "TYPE": true, "TTL": true, "PTTL": true,
+	"EXISTS": true, "TOUCH": true, "KEYS": true, "SCAN": true,
+	"RANDOMKEY": true, "DUMP": true, "RESTORE": true, "MIGRATE": true,
+	"MOVE": true, "COPY": true, "OBJECT": true,
+}
+
+// categoryFor derives an OpCategory bitmask for a command from its Flag
+// (read/write, fast/slow, and admin plus dangerous for FlagNotAllow) and a
+// handful of name-based overrides for the categories Flag doesn't track
+// (pubsub, scripting, connection, keyspace).
+func categoryFor(name string, flag OpFlag) OpCategory {
+	var cat OpCategory
+	switch {
+	case flag&FlagWrite != 0:
+		cat |= CategoryWrite
+	case flag&FlagNotAllow == 0 && flag&FlagMayWrite == 0:
+		cat |= CategoryRead
+	}
+	if flag&FlagNotAllow != 0 {
+		cat |= CategoryAdmin | CategoryDangerous
+	}
+	if pubsubOps[name] {
+		cat |= CategoryPubSub
+	}
+	if scriptingOps[name] {
+		cat |= CategoryScripting
+	}
+	if connectionOps[name] {
+		cat |= CategoryConnection
+	}
+	if keyspaceOps[name] {
+		cat |= CategoryKeyspace
+	}
+	if flag == 0 || flag == FlagWrite {
+		cat |= CategoryFast
+	} else {
+		cat |= CategorySlow
+	}
+	return cat
+}
+
+// Authorizer decides whether a connection, identified by the name it
+// authenticated as, may run a command.  It's consulted after getOpInfo has
+// classified the command but before it's dispatched.
+type Authorizer interface {
+	Authorize(user string, opstr string, flag OpFlag, cat OpCategory, key []byte) error
+}
+
+var ErrNotAuthorized = errors.New("NOPERM this user has no permissions to run this command")
+
+// Rule is one term of a user's allowlist, e.g. "+@read", "-@dangerous",
+// "+get", "-flushdb", or a key-pattern glob like "~cache:*".
+type Rule struct {
+	Allow   bool
+	Command string     // set for "+get" / "-flushdb" style rules
+	Cat     OpCategory // set for "+@read" / "-@dangerous" style rules
+	KeyGlob string     // set for "~pattern" style rules
+}
+
+// ParseRule parses a single ACL-style rule token.
+func ParseRule(tok string) (Rule, error) {
+	if len(tok) < 2 {
+		return Rule{}, errors.Errorf("invalid acl rule %q", tok)
+	}
+	var r Rule
+	switch tok[0] {
+	case '+':
+		r.Allow = true
+	case '-':
+		r.Allow = false
+	case '~':
+		return Rule{KeyGlob: tok[1:], Allow: true}, nil
+	default:
+		return Rule{}, errors.Errorf("invalid acl rule %q", tok)
+	}
+	body := tok[1:]
+	if strings.HasPrefix(body, "@") {
+		cat, ok := categoryNames[strings.ToLower(body[1:])]
+		if !ok {
+			return Rule{}, errors.Errorf("unknown acl category %q", body)
+		}
+		r.Cat = cat
+		return r, nil
+	}
+	r.Command = strings.ToUpper(body)
+	return r, nil
+}
+
+// Policy is the parsed allowlist for one user: an ordered list of rules
+// plus the key-pattern globs that gate which keys it may touch.  Later
+// rules override earlier ones, matching Redis ACL semantics.
+type Policy struct {
+	User     string
+	Rules    []Rule
+	KeyGlobs []string
+}
+
+// NewPolicy builds a Policy from a user name and its ACL rule tokens, e.g.
+// []string{"+@read", "-@dangerous", "+get", "-flushdb"}.
+func NewPolicy(user string, tokens []string) (*Policy, error) {
+	p := &Policy{User: user}
+	for _, tok := range tokens {
+		r, err := ParseRule(tok)
+		if err != nil {
+			return nil, err
+		}
+		if r.KeyGlob != "" {
+			p.KeyGlobs = append(p.KeyGlobs, r.KeyGlob)
+		} else {
+			p.Rules = append(p.Rules, r)
+		}
+	}
+	return p, nil
+}
+
+// Authorize implements Authorizer by walking the rule list in order and
+// keeping the verdict of the last rule that matches the command.
+func (p *Policy) Authorize(user, opstr string, flag OpFlag, cat OpCategory, key []byte) error {
+	allow := false
+	for _, r := range p.Rules {
+		switch {
+		case r.Command != "" && r.Command == opstr:
+			allow = r.Allow
+		case r.Cat != 0 && r.Cat&cat != 0:
+			allow = r.Allow
+		}
+	}
+	if !allow {
+		return errors.Trace(ErrNotAuthorized)
+	}
+	if len(p.KeyGlobs) != 0 && len(key) != 0 {
+		for _, g := range p.KeyGlobs {
+			if globMatch(g, string(key)) {
+				return nil
+			}
+		}
+		return errors.Trace(ErrNotAuthorized)
+	}
+	return nil
+}
+
+// globMatch supports the subset of glob syntax ACL key patterns use: '*'
+// matches any run of characters, everything else matches literally.
+func globMatch(pattern, s string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == s
+	}
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+	for _, p := range parts[1 : len(parts)-1] {
+		i := strings.Index(s, p)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(p):]
+	}
+	return strings.HasSuffix(s, parts[len(parts)-1])
+}
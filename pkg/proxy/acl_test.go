@@ -0,0 +1,84 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import "testing"
+
+func TestGlobMatch(t *testing.T) {
+	cases := []struct {
+		pattern, s string
+		want       bool
+	}{
+		{"*", "anything", true},
+		{"cache:*", "cache:1", true},
+		{"cache:*", "other:1", false},
+		{"cache:*", "cache:", true},
+		{"*:suffix", "a:suffix", true},
+		{"*:suffix", "a:suffix:b", false},
+		{"exact", "exact", true},
+		{"exact", "exactly", false},
+		{"a*b*c", "aXbYc", true},
+		{"a*b*c", "abc", true},
+		{"a*b*c", "ac", false},
+	}
+	for _, c := range cases {
+		if got := globMatch(c.pattern, c.s); got != c.want {
+			t.Errorf("globMatch(%q, %q) = %v, want %v", c.pattern, c.s, got, c.want)
+		}
+	}
+}
+
+func TestCategoryForNeverGrantsReadToNotAllowCommands(t *testing.T) {
+	// SHUTDOWN et al. are Flag == FlagNotAllow: purely admin, not a write.
+	// An operator granting +@read must not transitively grant them.
+	cat := categoryFor("SHUTDOWN", FlagNotAllow)
+	if cat&CategoryRead != 0 {
+		t.Errorf("categoryFor(SHUTDOWN) = %v, must not include CategoryRead", cat)
+	}
+	if cat&CategoryAdmin == 0 || cat&CategoryDangerous == 0 {
+		t.Errorf("categoryFor(SHUTDOWN) = %v, want CategoryAdmin|CategoryDangerous", cat)
+	}
+}
+
+func TestPolicyAuthorizePerKeyGlobs(t *testing.T) {
+	p, err := NewPolicy("analytics", []string{"+@read", "~cache:*"})
+	if err != nil {
+		t.Fatalf("NewPolicy: %v", err)
+	}
+
+	cat := categoryFor("GET", 0)
+	if err := p.Authorize("analytics", "GET", 0, cat, []byte("cache:1")); err != nil {
+		t.Errorf("allowed key cache:1 was rejected: %v", err)
+	}
+	if err := p.Authorize("analytics", "GET", 0, cat, []byte("secret:password")); err == nil {
+		t.Error("key outside ~cache:* was authorized, want rejection")
+	}
+}
+
+func TestPolicyAuthorizeRejectsDangerousEvenWithReadGrant(t *testing.T) {
+	p, err := NewPolicy("analytics", []string{"+@read", "-@dangerous"})
+	if err != nil {
+		t.Fatalf("NewPolicy: %v", err)
+	}
+
+	readCat := categoryFor("GET", 0)
+	if err := p.Authorize("analytics", "GET", 0, readCat, nil); err != nil {
+		t.Errorf("GET should be authorized: %v", err)
+	}
+
+	shutdownCat := categoryFor("SHUTDOWN", FlagNotAllow)
+	if err := p.Authorize("analytics", "SHUTDOWN", FlagNotAllow, shutdownCat, nil); err == nil {
+		t.Error("SHUTDOWN should be rejected by -@dangerous, was authorized")
+	}
+}
+
+func TestPolicyAuthorizeLaterRuleWins(t *testing.T) {
+	p, err := NewPolicy("svc", []string{"+get", "-get"})
+	if err != nil {
+		t.Fatalf("NewPolicy: %v", err)
+	}
+	if err := p.Authorize("svc", "GET", 0, categoryFor("GET", 0), nil); err == nil {
+		t.Error("later -get rule should override the earlier +get, want rejection")
+	}
+}
@@ -0,0 +1,332 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/errors"
+)
+
+// ClusterCompat records whether cluster-compat mode (Redis Cluster's 16384-
+// slot space instead of Codis' native 1024) is on.  Nothing reads the
+// variable itself: CLUSTER KEYSLOT and key routing both go through
+// hashSlot, i.e. the installed SlotHasher, so set it via SetClusterCompat,
+// which installs the matching hasher.
+var ClusterCompat = false
+
+// SetClusterCompat toggles ClusterCompat and swaps in the matching
+// SlotHasher in one step, so CLUSTER KEYSLOT's reported slot-space never
+// drifts out of sync with how keys are actually routed.
+func SetClusterCompat(enabled bool) {
+	ClusterCompat = enabled
+	if enabled {
+		SetSlotHasher(CRC16XModemHasher)
+	} else {
+		SetSlotHasher(CRC32Hasher)
+	}
+}
+
+// ClusterRedirect makes the proxy answer requests for keys that live on a
+// different shard than the one the client is pinned to with a MOVED (or, if
+// the slot is mid-migration, ASK) error instead of silently forwarding the
+// request itself, so cluster-aware clients can learn the real topology and
+// route around the proxy.  redirectForSlot (which redirectForKey wraps) is
+// what actually consults it.
+var ClusterRedirect = false
+
+var (
+	migratingMu sync.RWMutex
+	migratingTo = make(map[int]string)
+)
+
+// SetMigrating records that slot is being migrated to target, so
+// redirectForKey answers requests for its keys with ASK instead of MOVED
+// while the migration is in flight.  ClearMigrating removes that record
+// once the migration finishes and the slot table itself has been updated.
+func SetMigrating(slot int, target string) {
+	migratingMu.Lock()
+	defer migratingMu.Unlock()
+	migratingTo[slot] = target
+}
+
+func ClearMigrating(slot int) {
+	migratingMu.Lock()
+	defer migratingMu.Unlock()
+	delete(migratingTo, slot)
+}
+
+func migrationTarget(slot int) (string, bool) {
+	migratingMu.RLock()
+	defer migratingMu.RUnlock()
+	target, ok := migratingTo[slot]
+	return target, ok
+}
+
+// redirectForKey returns the MOVED/ASK error reply the proxy should send
+// for key instead of forwarding it, when ClusterRedirect is enabled and
+// either the key's slot is being migrated (ASK, even if localAddr owns it)
+// or it is owned by a master other than localAddr (MOVED).  ok is false
+// when the caller should proceed with its normal routing: ClusterRedirect
+// is off, or the slot isn't migrating and there's no topology yet, no shard
+// covers it, or it's already owned locally.
+func redirectForKey(key []byte, localAddr string) (resp *redis.Resp, ok bool) {
+	return redirectForSlot(hashSlot(key), localAddr)
+}
+
+// redirectForSlot is redirectForKey for callers (like DispatchSplit) that
+// already know the slot a SubRequest targets.
+func redirectForSlot(slot int, localAddr string) (resp *redis.Resp, ok bool) {
+	if !ClusterRedirect {
+		return nil, false
+	}
+	if target, migrating := migrationTarget(slot); migrating {
+		return redis.NewError([]byte(fmt.Sprintf("ASK %d %s", slot, target))), true
+	}
+	if clusterTopology == nil {
+		return nil, false
+	}
+	for _, s := range clusterTopology.ClusterSlots() {
+		if slot < s.Begin || slot > s.End {
+			continue
+		}
+		if s.Master == localAddr {
+			return nil, false
+		}
+		return redis.NewError([]byte(fmt.Sprintf("MOVED %d %s", slot, s.Master))), true
+	}
+	return nil, false
+}
+
+// ClusterSlot is one contiguous band of slots and the group serving
+// it, the shape CLUSTER SLOTS/SHARDS report per shard.
+type ClusterSlot struct {
+	Begin, End int
+	Master     string
+	Replicas   []string
+}
+
+// ClusterTopology is the slice of the proxy's router that the CLUSTER
+// command family needs: the current slot-to-group mapping.  The router
+// installs its implementation via SetClusterTopology at startup.
+type ClusterTopology interface {
+	ClusterSlots() []ClusterSlot
+}
+
+var clusterTopology ClusterTopology
+
+// SetClusterTopology wires the router's view of the slot table into the
+// CLUSTER command handlers.
+func SetClusterTopology(t ClusterTopology) {
+	clusterTopology = t
+}
+
+var ErrClusterSubcommand = errors.New("unknown CLUSTER subcommand")
+
+// ClusterCompatSlotNum is the slot-space size Redis Cluster clients expect,
+// used when ClusterCompat is enabled.
+const ClusterCompatSlotNum = 16384
+
+// CountKeysInSlot and GetKeysInSlot back CLUSTER COUNTKEYSINSLOT/
+// GETKEYSINSLOT.  Key enumeration isn't data the proxy keeps locally, so
+// the router wires these up to a dispatcher that runs SLOTSSCAN against
+// the backend owning the slot.
+var (
+	CountKeysInSlot func(slot int) int
+	GetKeysInSlot   func(slot int, count int) [][]byte
+)
+
+func countKeysInSlot(slot int) int {
+	if CountKeysInSlot == nil {
+		return 0
+	}
+	return CountKeysInSlot(slot)
+}
+
+func getKeysInSlot(slot, count int) [][]byte {
+	if GetKeysInSlot == nil {
+		return nil
+	}
+	return GetKeysInSlot(slot, count)
+}
+
+// handleCluster answers CLUSTER SLOTS/SHARDS/NODES/KEYSLOT/COUNTKEYSINSLOT/
+// GETKEYSINSLOT/INFO locally, out of the slot table in pkg/models, so that
+// cluster-aware clients don't need a Codis-specific shim.
+func handleCluster(multi []*redis.Resp) (*redis.Resp, error) {
+	if len(multi) < 2 {
+		return nil, errors.Trace(ErrBadMultiBulk)
+	}
+	sub := strings.ToUpper(string(multi[1].Value))
+	switch sub {
+	case "KEYSLOT":
+		if len(multi) != 3 {
+			return nil, errors.Trace(ErrBadMultiBulk)
+		}
+		return redis.NewInt(int64(hashSlot(multi[2].Value))), nil
+	case "COUNTKEYSINSLOT":
+		if len(multi) != 3 {
+			return nil, errors.Trace(ErrBadMultiBulk)
+		}
+		slot, err := strconv.Atoi(string(multi[2].Value))
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		return redis.NewInt(int64(countKeysInSlot(slot))), nil
+	case "GETKEYSINSLOT":
+		if len(multi) != 4 {
+			return nil, errors.Trace(ErrBadMultiBulk)
+		}
+		slot, err := strconv.Atoi(string(multi[2].Value))
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		count, err := strconv.Atoi(string(multi[3].Value))
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		keys := getKeysInSlot(slot, count)
+		out := make([]*redis.Resp, len(keys))
+		for i, k := range keys {
+			out[i] = redis.NewBulkBytes(k)
+		}
+		return redis.NewArray(out), nil
+	case "SLOTS":
+		return clusterSlotsReply(), nil
+	case "SHARDS":
+		return clusterShardsReply(), nil
+	case "NODES":
+		return redis.NewBulkBytes([]byte(clusterNodesReply())), nil
+	case "INFO":
+		return redis.NewBulkBytes([]byte(clusterInfoReply())), nil
+	default:
+		return nil, errors.Trace(ErrClusterSubcommand)
+	}
+}
+
+func clusterSlotsReply() *redis.Resp {
+	if clusterTopology == nil {
+		return redis.NewArray(nil)
+	}
+	var out []*redis.Resp
+	for _, s := range clusterTopology.ClusterSlots() {
+		entry := []*redis.Resp{
+			redis.NewInt(int64(s.Begin)),
+			redis.NewInt(int64(s.End)),
+			addrReply(s.Master),
+		}
+		for _, r := range s.Replicas {
+			entry = append(entry, addrReply(r))
+		}
+		out = append(out, redis.NewArray(entry))
+	}
+	return redis.NewArray(out)
+}
+
+func clusterShardsReply() *redis.Resp {
+	if clusterTopology == nil {
+		return redis.NewArray(nil)
+	}
+	var out []*redis.Resp
+	for _, s := range clusterTopology.ClusterSlots() {
+		slots := redis.NewArray([]*redis.Resp{redis.NewInt(int64(s.Begin)), redis.NewInt(int64(s.End))})
+		nodes := []*redis.Resp{nodeReply(s.Master, "master")}
+		for _, r := range s.Replicas {
+			nodes = append(nodes, nodeReply(r, "replica"))
+		}
+		out = append(out, redis.NewArray([]*redis.Resp{
+			redis.NewBulkBytes([]byte("slots")), slots,
+			redis.NewBulkBytes([]byte("nodes")), redis.NewArray(nodes),
+		}))
+	}
+	return redis.NewArray(out)
+}
+
+func nodeReply(addr, role string) *redis.Resp {
+	host, port := splitAddr(addr)
+	return redis.NewArray([]*redis.Resp{
+		redis.NewBulkBytes([]byte("id")), redis.NewBulkBytes([]byte(nodeID(addr))),
+		redis.NewBulkBytes([]byte("port")), redis.NewInt(int64(port)),
+		redis.NewBulkBytes([]byte("ip")), redis.NewBulkBytes([]byte(host)),
+		redis.NewBulkBytes([]byte("role")), redis.NewBulkBytes([]byte(role)),
+	})
+}
+
+func addrReply(addr string) *redis.Resp {
+	host, port := splitAddr(addr)
+	return redis.NewArray([]*redis.Resp{
+		redis.NewBulkBytes([]byte(host)),
+		redis.NewInt(int64(port)),
+		redis.NewBulkBytes([]byte(nodeID(addr))),
+	})
+}
+
+func clusterNodesReply() string {
+	if clusterTopology == nil {
+		return ""
+	}
+	var sb strings.Builder
+	for _, s := range clusterTopology.ClusterSlots() {
+		fmt.Fprintf(&sb, "%s %s master - 0 0 0 connected %d-%d\n",
+			nodeID(s.Master), s.Master, s.Begin, s.End)
+		for _, r := range s.Replicas {
+			fmt.Fprintf(&sb, "%s %s slave %s 0 0 0 connected\n", nodeID(r), r, nodeID(s.Master))
+		}
+	}
+	return sb.String()
+}
+
+func clusterInfoReply() string {
+	state := "ok"
+	if clusterTopology == nil {
+		state = "fail"
+	}
+	return fmt.Sprintf("cluster_enabled:1\r\ncluster_state:%s\r\ncluster_slots_assigned:%d\r\n", state, assignedSlotCount())
+}
+
+// assignedSlotCount sums the slots actually covered by clusterTopology's
+// shards, rather than assuming the whole slot space is assigned; a cluster
+// with unassigned groups should report that in CLUSTER INFO.
+func assignedSlotCount() int {
+	if clusterTopology == nil {
+		return 0
+	}
+	var n int
+	for _, s := range clusterTopology.ClusterSlots() {
+		n += s.End - s.Begin + 1
+	}
+	return n
+}
+
+// nodeID fabricates a stable-looking 40-char node id out of a backend
+// address, since Codis groups (unlike Redis Cluster nodes) don't carry one
+// of their own.  An empty addr (an unassigned group) maps to the all-zero
+// id rather than panicking.
+func nodeID(addr string) string {
+	const hex = "0123456789abcdef"
+	var b [40]byte
+	if addr == "" {
+		for i := range b {
+			b[i] = '0'
+		}
+		return string(b[:])
+	}
+	for i := range b {
+		b[i] = hex[(addr[i%len(addr)]+byte(i))%16]
+	}
+	return string(b[:])
+}
+
+func splitAddr(addr string) (string, int) {
+	i := strings.LastIndexByte(addr, ':')
+	if i < 0 {
+		return addr, 0
+	}
+	port, _ := strconv.Atoi(addr[i+1:])
+	return addr[:i], port
+}
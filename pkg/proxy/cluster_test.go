@@ -0,0 +1,106 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"bytes"
+	"testing"
+)
+
+func withClusterRedirect(t *testing.T, enabled bool) {
+	t.Helper()
+	prev := ClusterRedirect
+	ClusterRedirect = enabled
+	t.Cleanup(func() { ClusterRedirect = prev })
+}
+
+func withTopology(t *testing.T, topo ClusterTopology) {
+	t.Helper()
+	prev := clusterTopology
+	SetClusterTopology(topo)
+	t.Cleanup(func() { SetClusterTopology(prev) })
+}
+
+func TestAssignedSlotCountSumsTopology(t *testing.T) {
+	withTopology(t, fakeTopology{
+		{Begin: 0, End: 99, Master: "127.0.0.1:7000"},
+		{Begin: 200, End: 299, Master: "127.0.0.1:7001"},
+	})
+	if got := assignedSlotCount(); got != 200 {
+		t.Errorf("assignedSlotCount() = %d, want 200", got)
+	}
+}
+
+func TestAssignedSlotCountNoTopology(t *testing.T) {
+	withTopology(t, nil)
+	if got := assignedSlotCount(); got != 0 {
+		t.Errorf("assignedSlotCount() with no topology = %d, want 0", got)
+	}
+}
+
+func TestRedirectForSlotMoved(t *testing.T) {
+	withClusterRedirect(t, true)
+	withTopology(t, fakeTopology{
+		{Begin: 0, End: 99, Master: "127.0.0.1:7000"},
+	})
+
+	resp, ok := redirectForSlot(50, "127.0.0.1:7001")
+	if !ok {
+		t.Fatal("expected a redirect, got none")
+	}
+	if !bytes.Equal(resp.Value, []byte("MOVED 50 127.0.0.1:7000")) {
+		t.Errorf("redirect = %q", resp.Value)
+	}
+}
+
+func TestRedirectForSlotLocalNoRedirect(t *testing.T) {
+	withClusterRedirect(t, true)
+	withTopology(t, fakeTopology{
+		{Begin: 0, End: 99, Master: "127.0.0.1:7000"},
+	})
+
+	if _, ok := redirectForSlot(50, "127.0.0.1:7000"); ok {
+		t.Error("slot owned by localAddr should not redirect")
+	}
+}
+
+func TestRedirectForSlotDisabled(t *testing.T) {
+	withClusterRedirect(t, false)
+	withTopology(t, fakeTopology{
+		{Begin: 0, End: 99, Master: "127.0.0.1:7000"},
+	})
+
+	if _, ok := redirectForSlot(50, "127.0.0.1:7001"); ok {
+		t.Error("ClusterRedirect=false must never redirect")
+	}
+}
+
+func TestRedirectForSlotMigratingASK(t *testing.T) {
+	withClusterRedirect(t, true)
+	withTopology(t, fakeTopology{
+		{Begin: 0, End: 99, Master: "127.0.0.1:7000"},
+	})
+	SetMigrating(50, "127.0.0.1:7009")
+	defer ClearMigrating(50)
+
+	resp, ok := redirectForSlot(50, "127.0.0.1:7000")
+	if !ok {
+		t.Fatal("expected an ASK redirect for a migrating slot, got none")
+	}
+	if !bytes.Equal(resp.Value, []byte("ASK 50 127.0.0.1:7009")) {
+		t.Errorf("redirect = %q", resp.Value)
+	}
+}
+
+func TestNodeIDEmptyAddrDoesNotPanic(t *testing.T) {
+	id := nodeID("")
+	if len(id) != 40 {
+		t.Fatalf("nodeID(\"\") len = %d, want 40", len(id))
+	}
+	for _, c := range id {
+		if c != '0' {
+			t.Fatalf("nodeID(\"\") = %q, want all zeros", id)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"bytes"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+)
+
+// KeyPositionFn extracts the key getHashKey should route an op on from its
+// arguments.  Most commands put their key right after the verb, which
+// keyAtIndex(1) handles; commands that don't get an entry in keyPosTable.
+type KeyPositionFn func(multi []*redis.Resp) []byte
+
+var keyPosTable = map[string]KeyPositionFn{
+	"ZINTERSTORE": keyAtIndex(3),
+	"ZUNIONSTORE": keyAtIndex(3),
+	"EVAL":        keyAtIndex(3),
+	"EVALSHA":     keyAtIndex(3),
+
+	"LMPOP":  keyAtIndex(2),
+	"ZMPOP":  keyAtIndex(2),
+	"BLMPOP": keyAtIndex(3),
+	"BZMPOP": keyAtIndex(3),
+
+	"SINTERCARD": keyAtIndex(2),
+	"ZINTERCARD": keyAtIndex(2),
+	"ZDIFF":      keyAtIndex(2),
+	"ZINTER":     keyAtIndex(2),
+	"ZUNION":     keyAtIndex(2),
+
+	"XREAD":      keyAfterMarker("STREAMS"),
+	"XREADGROUP": keyAfterMarker("STREAMS"),
+
+	"XGROUP": keyAtIndex(2),
+	"XINFO":  keyAtIndex(2),
+
+	"OBJECT": objectKey,
+}
+
+// keyAtIndex returns a KeyPositionFn that picks the key at a fixed argument
+// index, the shape most commands use.
+func keyAtIndex(index int) KeyPositionFn {
+	return func(multi []*redis.Resp) []byte {
+		if index < len(multi) {
+			return multi[index].Value
+		}
+		return nil
+	}
+}
+
+// keyAfterMarker returns a KeyPositionFn for commands whose key list is
+// introduced by a literal marker token (e.g. XREAD's STREAMS) rather than
+// living at a fixed index; it returns the first key following the marker,
+// matching how getHashKey routes other multi-key commands on their first
+// key.
+func keyAfterMarker(marker string) KeyPositionFn {
+	return func(multi []*redis.Resp) []byte {
+		for i, r := range multi {
+			if bytes.EqualFold(r.Value, []byte(marker)) && i+1 < len(multi) {
+				return multi[i+1].Value
+			}
+		}
+		return nil
+	}
+}
+
+// objectKey routes OBJECT FREQ/ENCODING/IDLETIME/REFCOUNT by their key
+// argument, the one after the subcommand; the subcommand itself isn't
+// checked.  OBJECT HELP, with no argument after it, has no key.
+func objectKey(multi []*redis.Resp) []byte {
+	if len(multi) < 3 {
+		return nil
+	}
+	return multi[2].Value
+}
@@ -4,11 +4,8 @@
 package proxy
 
 import (
-	"bytes"
-	"hash/crc32"
 	"strings"
 
-	"github.com/CodisLabs/codis/pkg/models"
 	"github.com/CodisLabs/codis/pkg/proxy/redis"
 	"github.com/CodisLabs/codis/pkg/utils/errors"
 )
@@ -39,189 +36,231 @@ func (f OpFlag) IsReadOnly() bool {
 }
 
 type OpInfo struct {
-	Name string
-	Flag OpFlag
+	Name     string
+	Flag     OpFlag
+	Category OpCategory
 }
 
 const (
 	FlagWrite = 1 << iota
 	FlagMayWrite
 	FlagNotAllow
+	Splittable
 )
 
 var opTable = make(map[string]OpInfo, 256)
 
 func init() {
 	for _, i := range []OpInfo{
-		{"APPEND", FlagWrite},
-		{"AUTH", 0},
-		{"BGREWRITEAOF", FlagNotAllow},
-		{"BGSAVE", FlagNotAllow},
-		{"BITCOUNT", 0},
-		{"BITOP", FlagWrite | FlagNotAllow},
-		{"BITPOS", 0},
-		{"BLPOP", FlagWrite | FlagNotAllow},
-		{"BRPOP", FlagWrite | FlagNotAllow},
-		{"BRPOPLPUSH", FlagWrite | FlagNotAllow},
-		{"CLIENT", FlagNotAllow},
-		{"COMMAND", 0},
-		{"CONFIG", FlagNotAllow},
-		{"DBSIZE", FlagNotAllow},
-		{"DEBUG", FlagNotAllow},
-		{"DECR", FlagWrite},
-		{"DECRBY", FlagWrite},
-		{"DEL", FlagWrite},
-		{"DISCARD", FlagNotAllow},
-		{"DUMP", 0},
-		{"ECHO", 0},
-		{"EVAL", FlagWrite},
-		{"EVALSHA", FlagWrite},
-		{"EXEC", FlagNotAllow},
-		{"EXISTS", 0},
-		{"EXPIRE", FlagWrite},
-		{"EXPIREAT", FlagWrite},
-		{"FLUSHALL", FlagWrite | FlagNotAllow},
-		{"FLUSHDB", FlagWrite | FlagNotAllow},
-		{"GET", 0},
-		{"GETBIT", 0},
-		{"GETRANGE", 0},
-		{"GETSET", FlagWrite},
-		{"HDEL", FlagWrite},
-		{"HEXISTS", 0},
-		{"HGET", 0},
-		{"HGETALL", 0},
-		{"HINCRBY", FlagWrite},
-		{"HINCRBYFLOAT", FlagWrite},
-		{"HKEYS", 0},
-		{"HLEN", 0},
-		{"HMGET", 0},
-		{"HMSET", FlagWrite},
-		{"HSCAN", 0},
-		{"HSET", FlagWrite},
-		{"HSETNX", FlagWrite},
-		{"HVALS", 0},
-		{"INCR", FlagWrite},
-		{"INCRBY", FlagWrite},
-		{"INCRBYFLOAT", FlagWrite},
-		{"INFO", 0},
-		{"KEYS", FlagNotAllow},
-		{"LASTSAVE", FlagNotAllow},
-		{"LATENCY", FlagNotAllow},
-		{"LINDEX", 0},
-		{"LINSERT", FlagWrite},
-		{"LLEN", 0},
-		{"LPOP", FlagWrite},
-		{"LPUSH", FlagWrite},
-		{"LPUSHX", FlagWrite},
-		{"LRANGE", 0},
-		{"LREM", FlagWrite},
-		{"LSET", FlagWrite},
-		{"LTRIM", FlagWrite},
-		{"MGET", 0},
-		{"MIGRATE", FlagWrite | FlagNotAllow},
-		{"MONITOR", FlagNotAllow},
-		{"MOVE", FlagWrite | FlagNotAllow},
-		{"MSET", FlagWrite},
-		{"MSETNX", FlagWrite | FlagNotAllow},
-		{"MULTI", FlagNotAllow},
-		{"OBJECT", FlagNotAllow},
-		{"PERSIST", FlagWrite},
-		{"PEXPIRE", FlagWrite},
-		{"PEXPIREAT", FlagWrite},
-		{"PFADD", FlagWrite},
-		{"PFCOUNT", 0},
-		{"PFDEBUG", FlagWrite},
-		{"PFMERGE", FlagWrite},
-		{"PFSELFTEST", 0},
-		{"PING", 0},
-		{"PSETEX", FlagWrite},
-		{"PSUBSCRIBE", FlagNotAllow},
-		{"PSYNC", FlagNotAllow},
-		{"PTTL", 0},
-		{"PUBLISH", FlagNotAllow},
-		{"PUBSUB", 0},
-		{"PUNSUBSCRIBE", FlagNotAllow},
-		{"RANDOMKEY", FlagNotAllow},
-		{"RENAME", FlagWrite | FlagNotAllow},
-		{"RENAMENX", FlagWrite | FlagNotAllow},
-		{"REPLCONF", FlagNotAllow},
-		{"RESTORE", FlagWrite | FlagNotAllow},
-		{"ROLE", 0},
-		{"RPOP", FlagWrite},
-		{"RPOPLPUSH", FlagWrite},
-		{"RPUSH", FlagWrite},
-		{"RPUSHX", FlagWrite},
-		{"SADD", FlagWrite},
-		{"SAVE", FlagNotAllow},
-		{"SCAN", FlagNotAllow},
-		{"SCARD", 0},
-		{"SCRIPT", FlagNotAllow},
-		{"SDIFF", 0},
-		{"SDIFFSTORE", FlagWrite},
-		{"SELECT", 0},
-		{"SET", FlagWrite},
-		{"SETBIT", FlagWrite},
-		{"SETEX", FlagWrite},
-		{"SETNX", FlagWrite},
-		{"SETRANGE", FlagWrite},
-		{"SHUTDOWN", FlagNotAllow},
-		{"SINTER", 0},
-		{"SINTERSTORE", FlagWrite},
-		{"SISMEMBER", 0},
-		{"SLAVEOF", FlagNotAllow},
-		{"SLOTSCHECK", FlagNotAllow},
-		{"SLOTSDEL", FlagWrite | FlagNotAllow},
-		{"SLOTSHASHKEY", 0},
-		{"SLOTSINFO", FlagNotAllow},
-		{"SLOTSMAPPING", 0},
-		{"SLOTSMGRTONE", FlagWrite | FlagNotAllow},
-		{"SLOTSMGRTSLOT", FlagWrite | FlagNotAllow},
-		{"SLOTSMGRTTAGONE", FlagWrite | FlagNotAllow},
-		{"SLOTSMGRTTAGSLOT", FlagWrite | FlagNotAllow},
-		{"SLOTSRESTORE", FlagWrite},
-		{"SLOTSSCAN", 0},
-		{"SLOWLOG", FlagNotAllow},
-		{"SMEMBERS", 0},
-		{"SMOVE", FlagWrite},
-		{"SORT", FlagWrite},
-		{"SPOP", FlagWrite},
-		{"SRANDMEMBER", 0},
-		{"SREM", FlagWrite},
-		{"SSCAN", 0},
-		{"STRLEN", 0},
-		{"SUBSCRIBE", FlagNotAllow},
-		{"SUBSTR", 0},
-		{"SUNION", 0},
-		{"SUNIONSTORE", FlagWrite},
-		{"SYNC", FlagNotAllow},
-		{"TIME", FlagNotAllow},
-		{"TTL", 0},
-		{"TYPE", 0},
-		{"UNSUBSCRIBE", FlagNotAllow},
-		{"UNWATCH", FlagNotAllow},
-		{"WATCH", FlagNotAllow},
-		{"ZADD", FlagWrite},
-		{"ZCARD", 0},
-		{"ZCOUNT", 0},
-		{"ZINCRBY", FlagWrite},
-		{"ZINTERSTORE", FlagWrite},
-		{"ZLEXCOUNT", 0},
-		{"ZRANGE", 0},
-		{"ZRANGEBYLEX", 0},
-		{"ZRANGEBYSCORE", 0},
-		{"ZRANK", 0},
-		{"ZREM", FlagWrite},
-		{"ZREMRANGEBYLEX", FlagWrite},
-		{"ZREMRANGEBYRANK", FlagWrite},
-		{"ZREMRANGEBYSCORE", FlagWrite},
-		{"ZREVRANGE", 0},
-		{"ZREVRANGEBYLEX", 0},
-		{"ZREVRANGEBYSCORE", 0},
-		{"ZREVRANK", 0},
-		{"ZSCAN", 0},
-		{"ZSCORE", 0},
-		{"ZUNIONSTORE", FlagWrite},
+		{Name: "APPEND", Flag: FlagWrite},
+		{Name: "AUTH", Flag: 0},
+		{Name: "BGREWRITEAOF", Flag: FlagNotAllow},
+		{Name: "BGSAVE", Flag: FlagNotAllow},
+		{Name: "BITCOUNT", Flag: 0},
+		{Name: "BITOP", Flag: FlagWrite | FlagNotAllow},
+		{Name: "BITPOS", Flag: 0},
+		{Name: "BLMPOP", Flag: FlagWrite | FlagNotAllow},
+		{Name: "BLPOP", Flag: FlagWrite | FlagNotAllow},
+		{Name: "BRPOP", Flag: FlagWrite | FlagNotAllow},
+		{Name: "BRPOPLPUSH", Flag: FlagWrite | FlagNotAllow},
+		{Name: "BZMPOP", Flag: FlagWrite | FlagNotAllow},
+		{Name: "BZPOPMAX", Flag: FlagWrite | FlagNotAllow},
+		{Name: "BZPOPMIN", Flag: FlagWrite | FlagNotAllow},
+		{Name: "CLIENT", Flag: FlagNotAllow},
+		{Name: "CLUSTER", Flag: 0},
+		{Name: "COMMAND", Flag: 0},
+		{Name: "CONFIG", Flag: FlagNotAllow},
+		{Name: "COPY", Flag: FlagWrite | FlagNotAllow},
+		{Name: "DBSIZE", Flag: FlagNotAllow},
+		{Name: "DEBUG", Flag: FlagNotAllow},
+		{Name: "DECR", Flag: FlagWrite},
+		{Name: "DECRBY", Flag: FlagWrite},
+		{Name: "DEL", Flag: FlagWrite | Splittable},
+		{Name: "DISCARD", Flag: FlagNotAllow},
+		{Name: "DUMP", Flag: 0},
+		{Name: "ECHO", Flag: 0},
+		{Name: "EVAL", Flag: FlagWrite},
+		{Name: "EVALSHA", Flag: FlagWrite},
+		{Name: "EXEC", Flag: FlagNotAllow},
+		{Name: "EXISTS", Flag: Splittable},
+		{Name: "EXPIRE", Flag: FlagWrite},
+		{Name: "EXPIREAT", Flag: FlagWrite},
+		{Name: "FLUSHALL", Flag: FlagWrite | FlagNotAllow},
+		{Name: "FLUSHDB", Flag: FlagWrite | FlagNotAllow},
+		{Name: "GET", Flag: 0},
+		{Name: "GETBIT", Flag: 0},
+		{Name: "GETDEL", Flag: FlagWrite},
+		{Name: "GETEX", Flag: FlagWrite},
+		{Name: "GETRANGE", Flag: 0},
+		{Name: "GETSET", Flag: FlagWrite},
+		{Name: "HDEL", Flag: FlagWrite},
+		{Name: "HELLO", Flag: 0},
+		{Name: "HEXISTS", Flag: 0},
+		{Name: "HGET", Flag: 0},
+		{Name: "HGETALL", Flag: 0},
+		{Name: "HINCRBY", Flag: FlagWrite},
+		{Name: "HINCRBYFLOAT", Flag: FlagWrite},
+		{Name: "HKEYS", Flag: 0},
+		{Name: "HLEN", Flag: 0},
+		{Name: "HMGET", Flag: 0},
+		{Name: "HMSET", Flag: FlagWrite},
+		{Name: "HSCAN", Flag: 0},
+		{Name: "HSET", Flag: FlagWrite},
+		{Name: "HSETNX", Flag: FlagWrite},
+		{Name: "HVALS", Flag: 0},
+		{Name: "INCR", Flag: FlagWrite},
+		{Name: "INCRBY", Flag: FlagWrite},
+		{Name: "INCRBYFLOAT", Flag: FlagWrite},
+		{Name: "INFO", Flag: 0},
+		{Name: "KEYS", Flag: FlagNotAllow},
+		{Name: "LASTSAVE", Flag: FlagNotAllow},
+		{Name: "LATENCY", Flag: FlagNotAllow},
+		{Name: "LINDEX", Flag: 0},
+		{Name: "LINSERT", Flag: FlagWrite},
+		{Name: "LLEN", Flag: 0},
+		{Name: "LMPOP", Flag: FlagWrite},
+		{Name: "LPOP", Flag: FlagWrite},
+		{Name: "LPOS", Flag: 0},
+		{Name: "LPUSH", Flag: FlagWrite},
+		{Name: "LPUSHX", Flag: FlagWrite},
+		{Name: "LRANGE", Flag: 0},
+		{Name: "LREM", Flag: FlagWrite},
+		{Name: "LSET", Flag: FlagWrite},
+		{Name: "LTRIM", Flag: FlagWrite},
+		{Name: "MGET", Flag: Splittable},
+		{Name: "MIGRATE", Flag: FlagWrite | FlagNotAllow},
+		{Name: "MONITOR", Flag: FlagNotAllow},
+		{Name: "MOVE", Flag: FlagWrite | FlagNotAllow},
+		{Name: "MSET", Flag: FlagWrite | Splittable},
+		{Name: "MSETNX", Flag: FlagWrite | FlagNotAllow | Splittable},
+		{Name: "MULTI", Flag: FlagNotAllow},
+		{Name: "OBJECT", Flag: FlagNotAllow},
+		{Name: "PERSIST", Flag: FlagWrite},
+		{Name: "PEXPIRE", Flag: FlagWrite},
+		{Name: "PEXPIREAT", Flag: FlagWrite},
+		{Name: "PFADD", Flag: FlagWrite},
+		{Name: "PFCOUNT", Flag: 0},
+		{Name: "PFDEBUG", Flag: FlagWrite},
+		{Name: "PFMERGE", Flag: FlagWrite},
+		{Name: "PFSELFTEST", Flag: 0},
+		{Name: "PING", Flag: 0},
+		{Name: "PSETEX", Flag: FlagWrite},
+		{Name: "PSUBSCRIBE", Flag: FlagNotAllow},
+		{Name: "PSYNC", Flag: FlagNotAllow},
+		{Name: "PTTL", Flag: 0},
+		{Name: "PUBLISH", Flag: FlagNotAllow},
+		{Name: "PUBSUB", Flag: 0},
+		{Name: "PUNSUBSCRIBE", Flag: FlagNotAllow},
+		{Name: "RANDOMKEY", Flag: FlagNotAllow},
+		{Name: "RENAME", Flag: FlagWrite | FlagNotAllow},
+		{Name: "RENAMENX", Flag: FlagWrite | FlagNotAllow},
+		{Name: "REPLCONF", Flag: FlagNotAllow},
+		{Name: "RESTORE", Flag: FlagWrite | FlagNotAllow},
+		{Name: "ROLE", Flag: 0},
+		{Name: "RPOP", Flag: FlagWrite},
+		{Name: "RPOPLPUSH", Flag: FlagWrite},
+		{Name: "RPUSH", Flag: FlagWrite},
+		{Name: "RPUSHX", Flag: FlagWrite},
+		{Name: "SADD", Flag: FlagWrite},
+		{Name: "SAVE", Flag: FlagNotAllow},
+		{Name: "SCAN", Flag: FlagNotAllow},
+		{Name: "SCARD", Flag: 0},
+		{Name: "SCRIPT", Flag: FlagNotAllow},
+		{Name: "SDIFF", Flag: 0},
+		{Name: "SDIFFSTORE", Flag: FlagWrite | Splittable},
+		{Name: "SELECT", Flag: 0},
+		{Name: "SET", Flag: FlagWrite},
+		{Name: "SETBIT", Flag: FlagWrite},
+		{Name: "SETEX", Flag: FlagWrite},
+		{Name: "SETNX", Flag: FlagWrite},
+		{Name: "SETRANGE", Flag: FlagWrite},
+		{Name: "SHUTDOWN", Flag: FlagNotAllow},
+		{Name: "SINTER", Flag: 0},
+		{Name: "SINTERCARD", Flag: 0},
+		{Name: "SINTERSTORE", Flag: FlagWrite | Splittable},
+		{Name: "SISMEMBER", Flag: 0},
+		{Name: "SLAVEOF", Flag: FlagNotAllow},
+		{Name: "SLOTSCHECK", Flag: FlagNotAllow},
+		{Name: "SLOTSDEL", Flag: FlagWrite | FlagNotAllow},
+		{Name: "SLOTSHASHKEY", Flag: 0},
+		{Name: "SLOTSINFO", Flag: FlagNotAllow},
+		{Name: "SLOTSMAPPING", Flag: 0},
+		{Name: "SLOTSMGRTONE", Flag: FlagWrite | FlagNotAllow},
+		{Name: "SLOTSMGRTSLOT", Flag: FlagWrite | FlagNotAllow},
+		{Name: "SLOTSMGRTTAGONE", Flag: FlagWrite | FlagNotAllow},
+		{Name: "SLOTSMGRTTAGSLOT", Flag: FlagWrite | FlagNotAllow},
+		{Name: "SLOTSRESTORE", Flag: FlagWrite},
+		{Name: "SLOTSSCAN", Flag: 0},
+		{Name: "SLOWLOG", Flag: FlagNotAllow},
+		{Name: "SMEMBERS", Flag: 0},
+		{Name: "SMISMEMBER", Flag: 0},
+		{Name: "SMOVE", Flag: FlagWrite},
+		{Name: "SORT", Flag: FlagWrite},
+		{Name: "SPOP", Flag: FlagWrite},
+		{Name: "SRANDMEMBER", Flag: 0},
+		{Name: "SREM", Flag: FlagWrite},
+		{Name: "SSCAN", Flag: 0},
+		{Name: "STRLEN", Flag: 0},
+		{Name: "SUBSCRIBE", Flag: FlagNotAllow},
+		{Name: "SUBSTR", Flag: 0},
+		{Name: "SUNION", Flag: 0},
+		{Name: "SUNIONSTORE", Flag: FlagWrite | Splittable},
+		{Name: "SYNC", Flag: FlagNotAllow},
+		{Name: "TIME", Flag: FlagNotAllow},
+		{Name: "TOUCH", Flag: Splittable},
+		{Name: "TTL", Flag: 0},
+		{Name: "TYPE", Flag: 0},
+		{Name: "UNLINK", Flag: FlagWrite | Splittable},
+		{Name: "UNSUBSCRIBE", Flag: FlagNotAllow},
+		{Name: "UNWATCH", Flag: FlagNotAllow},
+		{Name: "WATCH", Flag: FlagNotAllow},
+		{Name: "XACK", Flag: FlagWrite},
+		{Name: "XADD", Flag: FlagWrite},
+		{Name: "XAUTOCLAIM", Flag: FlagWrite},
+		{Name: "XCLAIM", Flag: FlagWrite},
+		{Name: "XDEL", Flag: FlagWrite},
+		{Name: "XGROUP", Flag: FlagWrite},
+		{Name: "XINFO", Flag: 0},
+		{Name: "XLEN", Flag: 0},
+		{Name: "XPENDING", Flag: 0},
+		{Name: "XRANGE", Flag: 0},
+		{Name: "XREAD", Flag: 0},
+		{Name: "XREADGROUP", Flag: FlagWrite},
+		{Name: "XREVRANGE", Flag: 0},
+		{Name: "XSETID", Flag: FlagWrite},
+		{Name: "XTRIM", Flag: FlagWrite},
+		{Name: "ZADD", Flag: FlagWrite},
+		{Name: "ZCARD", Flag: 0},
+		{Name: "ZCOUNT", Flag: 0},
+		{Name: "ZDIFF", Flag: 0},
+		{Name: "ZDIFFSTORE", Flag: FlagWrite},
+		{Name: "ZINCRBY", Flag: FlagWrite},
+		{Name: "ZINTER", Flag: 0},
+		{Name: "ZINTERCARD", Flag: 0},
+		{Name: "ZINTERSTORE", Flag: FlagWrite},
+		{Name: "ZLEXCOUNT", Flag: 0},
+		{Name: "ZMPOP", Flag: FlagWrite},
+		{Name: "ZPOPMAX", Flag: FlagWrite},
+		{Name: "ZPOPMIN", Flag: FlagWrite},
+		{Name: "ZRANGE", Flag: 0},
+		{Name: "ZRANGEBYLEX", Flag: 0},
+		{Name: "ZRANGEBYSCORE", Flag: 0},
+		{Name: "ZRANGESTORE", Flag: FlagWrite},
+		{Name: "ZRANK", Flag: 0},
+		{Name: "ZREM", Flag: FlagWrite},
+		{Name: "ZREMRANGEBYLEX", Flag: FlagWrite},
+		{Name: "ZREMRANGEBYRANK", Flag: FlagWrite},
+		{Name: "ZREMRANGEBYSCORE", Flag: FlagWrite},
+		{Name: "ZREVRANGE", Flag: 0},
+		{Name: "ZREVRANGEBYLEX", Flag: 0},
+		{Name: "ZREVRANGEBYSCORE", Flag: 0},
+		{Name: "ZREVRANK", Flag: 0},
+		{Name: "ZSCAN", Flag: 0},
+		{Name: "ZSCORE", Flag: 0},
+		{Name: "ZUNION", Flag: 0},
+		{Name: "ZUNIONSTORE", Flag: FlagWrite},
 	} {
+		i.Category = categoryFor(i.Name, i.Flag)
 		opTable[i.Name] = i
 	}
 }
@@ -253,32 +292,44 @@ func getOpInfo(multi []*redis.Resp) (string, OpFlag, error) {
 	}
 	op = upper[:len(op)]
 	if r, ok := opTable[string(op)]; ok {
-		return r.Name, r.Flag, nil
+		return r.Name, effectiveFlag(r, multi), nil
 	}
 	return string(op), FlagMayWrite, nil
 }
 
-func hashSlot(key []byte) int {
-	const (
-		TagBeg = '{'
-		TagEnd = '}'
-	)
-	if beg := bytes.IndexByte(key, TagBeg); beg >= 0 {
-		if end := bytes.IndexByte(key[beg+1:], TagEnd); end >= 0 {
-			key = key[beg+1 : beg+1+end]
-		}
+// subcommandAllow carves narrow exceptions out of a FlagNotAllow command
+// for the handful of its subcommands that are safe to let through, so an
+// otherwise-blocked command like OBJECT or CLIENT doesn't have to be
+// unblocked wholesale just to permit OBJECT FREQ or CLIENT TRACKING.
+var subcommandAllow = map[string]map[string]bool{
+	"OBJECT": {"FREQ": true, "HELP": true},
+	"CLIENT": {"TRACKING": true, "TRACKINGINFO": true, "GETNAME": true, "SETNAME": true, "ID": true},
+}
+
+// effectiveFlag applies subcommandAllow on top of an OpInfo's base Flag:
+// a FlagNotAllow command whose first argument names an allowed subcommand
+// has FlagNotAllow cleared for this call only; opTable itself is untouched.
+func effectiveFlag(r OpInfo, multi []*redis.Resp) OpFlag {
+	if r.Flag&FlagNotAllow == 0 || len(multi) < 2 {
+		return r.Flag
+	}
+	allowed, ok := subcommandAllow[r.Name]
+	if !ok {
+		return r.Flag
 	}
-	return int(crc32.ChecksumIEEE(key) % models.MaxSlotNum)
+	if allowed[strings.ToUpper(string(multi[1].Value))] {
+		return r.Flag &^ FlagNotAllow
+	}
+	return r.Flag
+}
+
+func hashSlot(key []byte) int {
+	return activeHasher.Slot(key)
 }
 
 func getHashKey(multi []*redis.Resp, opstr string) []byte {
-	var index = 1
-	switch opstr {
-	case "ZINTERSTORE", "ZUNIONSTORE", "EVAL", "EVALSHA":
-		index = 3
-	}
-	if index < len(multi) {
-		return multi[index].Value
+	if fn, ok := keyPosTable[opstr]; ok {
+		return fn(multi)
 	}
-	return nil
+	return keyAtIndex(1)(multi)
 }
@@ -0,0 +1,98 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"bytes"
+	"hash/crc32"
+
+	"github.com/CodisLabs/codis/pkg/models"
+)
+
+// SlotHasher maps a key to a hash slot.  hashSlot delegates to whichever
+// implementation is installed with SetSlotHasher, so the proxy can be
+// switched between Codis' native slot space and one compatible with Redis
+// Cluster without touching any of the routing code built on top of it.
+type SlotHasher interface {
+	Slot(key []byte) int
+}
+
+// hashTag returns the part of key that should actually be hashed: the
+// substring between the first '{' and the next '}' if both are present,
+// otherwise the whole key.  An empty tag ("{}") is hashed as the empty
+// string, as Codis always has.  Both SlotHasher implementations
+// below use it, so switching hashers never changes hash-tag semantics.
+func hashTag(key []byte) []byte {
+	const (
+		TagBeg = '{'
+		TagEnd = '}'
+	)
+	if beg := bytes.IndexByte(key, TagBeg); beg >= 0 {
+		if end := bytes.IndexByte(key[beg+1:], TagEnd); end >= 0 {
+			return key[beg+1 : beg+1+end]
+		}
+	}
+	return key
+}
+
+// crc32Hasher is Codis' original hashing scheme: CRC32/IEEE over a 1024-
+// slot space.
+type crc32Hasher struct{}
+
+func (crc32Hasher) Slot(key []byte) int {
+	return int(crc32.ChecksumIEEE(hashTag(key)) % models.MaxSlotNum)
+}
+
+// crc16XModemHasher is Redis Cluster's scheme: CRC16-XMODEM over a 16384-
+// slot space.  Enabling it (via SetSlotHasher) lets Codis place keys the
+// same way a Redis Cluster deployment would, which CLUSTER KEYSLOT relies
+// on to report slots clients can trust.
+type crc16XModemHasher struct{}
+
+func (crc16XModemHasher) Slot(key []byte) int {
+	return int(crc16XModem(hashTag(key))) % ClusterCompatSlotNum
+}
+
+var crc16XModemTable [256]uint16
+
+func init() {
+	const poly = 0x1021
+	for i := 0; i < 256; i++ {
+		crc := uint16(i) << 8
+		for b := 0; b < 8; b++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ poly
+			} else {
+				crc <<= 1
+			}
+		}
+		crc16XModemTable[i] = crc
+	}
+}
+
+func crc16XModem(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc = crc<<8 ^ crc16XModemTable[byte(crc>>8)^b]
+	}
+	return crc
+}
+
+var (
+	// CRC32Hasher is Codis' original 1024-slot CRC32 hasher.
+	CRC32Hasher SlotHasher = crc32Hasher{}
+	// CRC16XModemHasher is the 16384-slot CRC16-XMODEM hasher Redis
+	// Cluster clients expect.
+	CRC16XModemHasher SlotHasher = crc16XModemHasher{}
+)
+
+var activeHasher = CRC32Hasher
+
+// SetSlotHasher installs the SlotHasher hashSlot delegates to.  Proxy
+// config selects CRC16XModemHasher when cluster-compat mode is enabled,
+// keeping it in lockstep with ClusterCompat so CLUSTER KEYSLOT and actual
+// routing never disagree.
+func SetSlotHasher(h SlotHasher) {
+	activeHasher = h
+}
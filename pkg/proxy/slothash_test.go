@@ -0,0 +1,67 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import "testing"
+
+// crc16XModem check values below are the standard CRC-16/XMODEM test
+// vectors (poly 0x1021, init 0x0000, no reflection, no xorout) -- the same
+// parameters Redis Cluster uses for its slot hash.
+func TestCRC16XModemVectors(t *testing.T) {
+	cases := []struct {
+		data string
+		want uint16
+	}{
+		{"123456789", 0x31C3},
+		{"", 0x0000},
+	}
+	for _, c := range cases {
+		if got := crc16XModem([]byte(c.data)); got != c.want {
+			t.Errorf("crc16XModem(%q) = %#04x, want %#04x", c.data, got, c.want)
+		}
+	}
+}
+
+func TestCRC16XModemHasherSlotRange(t *testing.T) {
+	h := crc16XModemHasher{}
+	for _, key := range []string{"foo", "bar", "{user1000}.following", "123456789"} {
+		slot := h.Slot([]byte(key))
+		if slot < 0 || slot >= ClusterCompatSlotNum {
+			t.Errorf("Slot(%q) = %d, out of range [0,%d)", key, slot, ClusterCompatSlotNum)
+		}
+	}
+}
+
+func TestCRC16XModemHasherKnownSlot(t *testing.T) {
+	// crc16("123456789") == 0x31C3 == 12739, within the 16384-slot space
+	// so the mod is a no-op; this pins the hasher to the standard vector.
+	h := crc16XModemHasher{}
+	if got := h.Slot([]byte("123456789")); got != 12739 {
+		t.Errorf("Slot(123456789) = %d, want 12739", got)
+	}
+}
+
+func TestHashTagUsesBracesWhenPresent(t *testing.T) {
+	h := crc16XModemHasher{}
+	a := h.Slot([]byte("{user1000}.following"))
+	b := h.Slot([]byte("{user1000}.followers"))
+	if a != b {
+		t.Errorf("keys sharing hash tag {user1000} landed in different slots: %d vs %d", a, b)
+	}
+	c := h.Slot([]byte("user1000"))
+	if a != c {
+		t.Errorf("hash tag {user1000} should hash the same as the bare key user1000: %d vs %d", a, c)
+	}
+}
+
+func TestCRC32HasherSlotRange(t *testing.T) {
+	// 1024 mirrors models.MaxSlotNum, Codis' native slot-space size.
+	h := crc32Hasher{}
+	for _, key := range []string{"foo", "bar", "{user1000}.following"} {
+		slot := h.Slot([]byte(key))
+		if slot < 0 || slot >= 1024 {
+			t.Errorf("Slot(%q) = %d, out of range [0,1024)", key, slot)
+		}
+	}
+}
@@ -0,0 +1,393 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"strings"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/errors"
+)
+
+// SplitMultiKey enables scatter-gather routing for commands flagged
+// Splittable.  When false (the default), a multi-key command is pinned to
+// the slot of its first key, same as before this was introduced.
+var SplitMultiKey = false
+
+// AllowCrossSlotWrite controls what happens when a Splittable write (MSET,
+// DEL, UNLINK) touches more than one slot.  When false, the command is
+// rejected with ErrCrossSlot and the caller is expected to shard it itself;
+// when true, each slot's share of the write is applied independently, i.e.
+// atomically per-shard but not across the whole command.  It does not apply
+// to MSETNX (see AllowCrossSlotMSETNX) or to SUNIONSTORE/SDIFFSTORE/
+// SINTERSTORE, which are always rejected when their keys span slots.
+var AllowCrossSlotWrite = false
+
+// AllowCrossSlotMSETNX is a separate opt-in from AllowCrossSlotWrite for
+// MSETNX specifically: MSETNX's whole point is "all keys or none", a
+// guarantee that's impossible to keep once the keys are split across
+// shards (each shard can only check its own slice for existing keys).
+// Turning on AllowCrossSlotWrite for plain MSET must not silently start
+// degrading MSETNX's atomicity too, so it needs its own flag.
+var AllowCrossSlotMSETNX = false
+
+// ErrCrossSlot is returned by splitRequest when a write's keys span more
+// than one slot and the write may not be split: AllowCrossSlotWrite is
+// false (MSETNX: AllowCrossSlotMSETNX is false), or the command is
+// SUNIONSTORE/SDIFFSTORE/SINTERSTORE.
+var ErrCrossSlot = errors.New("command keys span multiple slots (CROSSSLOT)")
+
+// ErrOpNotAllowed is returned for a FlagNotAllow command that isn't
+// exempted by splittableAllowed.
+var ErrOpNotAllowed = errors.New("command not allowed")
+
+// splittableAllowed reports whether a FlagNotAllow command should still go
+// through because it's Splittable and the operator has opted into
+// SplitMultiKey.  MSETNX, for instance, stays FlagNotAllow in opTable so
+// that it's blocked exactly as before unless an operator has explicitly
+// turned splitting on; un-split, forwarding it to a single backend keyed
+// off its first argument would silently write some of its keys into the
+// wrong shard.
+func splittableAllowed(flag OpFlag) bool {
+	return flag&Splittable != 0 && SplitMultiKey
+}
+
+// opKeys returns every key a splitTable command's arguments name, in
+// argument order.  It backs authKeys' per-key ACL check and splitStore's
+// per-slot grouping; the other splitFns take every argument as a key, the
+// same list opKeys returns for those commands.
+func opKeys(opstr string, multi []*redis.Resp) [][]byte {
+	args := multi[1:]
+	switch opstr {
+	case "MSET", "MSETNX":
+		keys := make([][]byte, len(args)/2)
+		for i := range keys {
+			keys[i] = args[i*2].Value
+		}
+		return keys
+	default:
+		keys := make([][]byte, len(args))
+		for i, r := range args {
+			keys[i] = r.Value
+		}
+		return keys
+	}
+}
+
+// authKeys returns every key DispatchSplit must run past cfg.Authz before
+// dispatching opstr: every key in splitTable for a Splittable command (so
+// fanning it out to multiple shards can't smuggle a key past the ACL that
+// getHashKey's single routing key would have caught), or getHashKey's one
+// key for anything else.
+func authKeys(opstr string, multi []*redis.Resp) [][]byte {
+	if _, ok := splitTable[opstr]; ok {
+		return opKeys(opstr, multi)
+	}
+	if key := getHashKey(multi, opstr); key != nil {
+		return [][]byte{key}
+	}
+	return nil
+}
+
+// SubRequest is one slot-local fragment of a command split by
+// splitRequest, ready to be dispatched to the backend owning Slot.
+type SubRequest struct {
+	Slot  int
+	Multi []*redis.Resp
+}
+
+// MergeFn recombines the per-slot replies of a split command, given in the
+// same order as the []SubRequest returned alongside it, into the single
+// reply the client is expecting.
+type MergeFn func(sub []SubRequest, reply []*redis.Resp) (*redis.Resp, error)
+
+type splitFn func(multi []*redis.Resp) ([]SubRequest, MergeFn, error)
+
+var splitTable = map[string]splitFn{
+	"MGET":        splitGather,
+	"DEL":         splitCount,
+	"UNLINK":      splitCount,
+	"EXISTS":      splitCount,
+	"TOUCH":       splitCount,
+	"MSET":        splitStore,
+	"MSETNX":      splitStore,
+	"SUNIONSTORE": splitDestOp,
+	"SDIFFSTORE":  splitDestOp,
+	"SINTERSTORE": splitDestOp,
+}
+
+// splitRequest breaks a Splittable command into per-slot SubRequests and
+// returns the MergeFn that reassembles their replies.  A nil split means
+// the command doesn't need scatter-gather, either because SplitMultiKey is
+// off, the command has no splitter, or all of its keys share one slot; the
+// caller should fall back to ordinary single-slot dispatch in that case.
+func splitRequest(multi []*redis.Resp, opstr string) ([]SubRequest, MergeFn, error) {
+	if !SplitMultiKey {
+		return nil, nil, nil
+	}
+	fn, ok := splitTable[opstr]
+	if !ok {
+		return nil, nil, nil
+	}
+	return fn(multi)
+}
+
+// BackendDispatch sends one slot-local fragment of a split command to the
+// backend that owns that slot and returns its reply.  DispatchSplit is the
+// only thing that calls it; the connection/session layer supplies the
+// implementation, since splitRequest and SubRequest don't know how
+// backends are actually reached.
+type BackendDispatch func(slot int, multi []*redis.Resp) (*redis.Resp, error)
+
+// DispatchConfig bundles the per-connection and per-proxy state
+// DispatchSplit needs beyond the command itself.  Authz/User are optional:
+// a nil Authz skips the per-connection ACL check entirely, matching a
+// proxy that hasn't configured one.
+type DispatchConfig struct {
+	User      string
+	Authz     Authorizer
+	LocalAddr string
+	Tracker   *Tracker
+	Send      BackendDispatch
+}
+
+// DispatchSplit runs a command through scatter-gather end to end: it
+// classifies the op, rejects it if FlagNotAllow applies and it isn't
+// exempted by splittableAllowed, runs every key it touches past cfg.Authz,
+// splits it, and resolves a MOVED/ASK redirect for every resulting
+// SubRequest's slot up front — before sending any of them — so a command
+// that fans out across shards either runs in full or is rejected in full,
+// never partially applied with some fragments already sent and others
+// bounced back as a redirect. It then sends each fragment through
+// cfg.Send, merges the replies back into the single reply the client
+// expects, and invalidates any tracked keys the command wrote along the
+// way. ok is false when the op didn't need splitting (no splitter,
+// SplitMultiKey is off, or its keys all share one slot), in which case the
+// caller should fall back to its ordinary single-slot dispatch (which is
+// responsible for the same Authz/Tracker bookkeeping on that path itself).
+func DispatchSplit(multi []*redis.Resp, cfg DispatchConfig) (reply *redis.Resp, ok bool, err error) {
+	opstr, flag, err := getOpInfo(multi)
+	if err != nil {
+		return nil, false, err
+	}
+	if flag.IsNotAllow() && !splittableAllowed(flag) {
+		return nil, false, errors.Trace(ErrOpNotAllowed)
+	}
+	if cfg.Authz != nil {
+		for _, key := range authKeys(opstr, multi) {
+			if err := cfg.Authz.Authorize(cfg.User, opstr, flag, opTable[opstr].Category, key); err != nil {
+				return nil, false, err
+			}
+		}
+	}
+	subs, merge, err := splitRequest(multi, opstr)
+	if err != nil {
+		return nil, false, err
+	}
+	if subs == nil {
+		return nil, false, nil
+	}
+	for _, sub := range subs {
+		if redirect, moved := redirectForSlot(sub.Slot, cfg.LocalAddr); moved {
+			return redirect, true, nil
+		}
+	}
+	replies := make([]*redis.Resp, len(subs))
+	for i, sub := range subs {
+		r, err := cfg.Send(sub.Slot, sub.Multi)
+		if err != nil {
+			return nil, true, err
+		}
+		replies[i] = r
+		if cfg.Tracker != nil && flag&FlagWrite != 0 {
+			for _, key := range writtenKeys(opstr, sub.Multi) {
+				cfg.Tracker.Invalidate(key)
+			}
+		}
+	}
+	reply, err = merge(subs, replies)
+	return reply, true, err
+}
+
+// writtenKeys lists the keys a split write's SubRequest fragment actually
+// touches, so DispatchSplit can invalidate them for CLIENT TRACKING
+// clients. Commands DispatchSplit doesn't have a splitter for never reach
+// here.
+func writtenKeys(opstr string, multi []*redis.Resp) [][]byte {
+	args := multi[1:]
+	switch opstr {
+	case "MSET", "MSETNX":
+		keys := make([][]byte, 0, len(args)/2)
+		for i := 0; i+1 < len(args); i += 2 {
+			keys = append(keys, args[i].Value)
+		}
+		return keys
+	case "DEL", "UNLINK":
+		keys := make([][]byte, len(args))
+		for i, r := range args {
+			keys[i] = r.Value
+		}
+		return keys
+	default:
+		return nil
+	}
+}
+
+// keySlots groups the indices of keys by the slot they hash to, preserving
+// the relative order of keys within each group.
+func keySlots(keys [][]byte) map[int][]int {
+	groups := make(map[int][]int)
+	for i, key := range keys {
+		slot := hashSlot(key)
+		groups[slot] = append(groups[slot], i)
+	}
+	return groups
+}
+
+// splitGather handles MGET: one bulk-string key per argument, merged back
+// into a single array reply in the original order.
+func splitGather(multi []*redis.Resp) ([]SubRequest, MergeFn, error) {
+	args := multi[1:]
+	if len(args) == 0 {
+		return nil, nil, errors.Trace(ErrBadMultiBulk)
+	}
+	keys := make([][]byte, len(args))
+	for i, r := range args {
+		keys[i] = r.Value
+	}
+	groups := keySlots(keys)
+	if len(groups) <= 1 {
+		return nil, nil, nil
+	}
+	subs, order := make([]SubRequest, 0, len(groups)), make([][]int, 0, len(groups))
+	for slot, idx := range groups {
+		sub := make([]*redis.Resp, 1, len(idx)+1)
+		sub[0] = multi[0]
+		for _, i := range idx {
+			sub = append(sub, args[i])
+		}
+		subs = append(subs, SubRequest{Slot: slot, Multi: sub})
+		order = append(order, idx)
+	}
+	merge := func(_ []SubRequest, reply []*redis.Resp) (*redis.Resp, error) {
+		out := make([]*redis.Resp, len(keys))
+		for i, r := range reply {
+			for j, idx := range order[i] {
+				out[idx] = r.Array[j]
+			}
+		}
+		return redis.NewArray(out), nil
+	}
+	return subs, merge, nil
+}
+
+// splitCount handles DEL/UNLINK/EXISTS/TOUCH: every argument is a key, and
+// the per-slot integer replies are summed.
+func splitCount(multi []*redis.Resp) ([]SubRequest, MergeFn, error) {
+	args := multi[1:]
+	if len(args) == 0 {
+		return nil, nil, errors.Trace(ErrBadMultiBulk)
+	}
+	keys := make([][]byte, len(args))
+	for i, r := range args {
+		keys[i] = r.Value
+	}
+	groups := keySlots(keys)
+	if len(groups) <= 1 {
+		return nil, nil, nil
+	}
+	if !AllowCrossSlotWrite && opIsWrite(multi) {
+		return nil, nil, errors.Trace(ErrCrossSlot)
+	}
+	var subs []SubRequest
+	for slot, idx := range groups {
+		sub := make([]*redis.Resp, 1, len(idx)+1)
+		sub[0] = multi[0]
+		for _, i := range idx {
+			sub = append(sub, args[i])
+		}
+		subs = append(subs, SubRequest{Slot: slot, Multi: sub})
+	}
+	merge := func(_ []SubRequest, reply []*redis.Resp) (*redis.Resp, error) {
+		var sum int64
+		for _, r := range reply {
+			sum += redis.ParseInt(r.Value)
+		}
+		return redis.NewInt(sum), nil
+	}
+	return subs, merge, nil
+}
+
+// splitStore handles MSET/MSETNX: arguments come in (key, value) pairs.
+// Each slot gets its own fragment with the original verb (MSET or MSETNX);
+// the merged reply is +OK (MSET) or
+// the logical AND of the per-shard results (MSETNX), since the set as a
+// whole can no longer be applied atomically once it spans shards.
+func splitStore(multi []*redis.Resp) ([]SubRequest, MergeFn, error) {
+	args := multi[1:]
+	if len(args) == 0 || len(args)%2 != 0 {
+		return nil, nil, errors.Trace(ErrBadMultiBulk)
+	}
+	keys := opKeys("MSET", multi)
+	groups := keySlots(keys)
+	if len(groups) <= 1 {
+		return nil, nil, nil
+	}
+	isSetNx := strings.EqualFold(string(multi[0].Value), "MSETNX")
+	if isSetNx {
+		if !AllowCrossSlotMSETNX {
+			return nil, nil, errors.Trace(ErrCrossSlot)
+		}
+	} else if !AllowCrossSlotWrite {
+		return nil, nil, errors.Trace(ErrCrossSlot)
+	}
+	var subs []SubRequest
+	for slot, idx := range groups {
+		sub := make([]*redis.Resp, 1, 1+len(idx)*2)
+		sub[0] = multi[0]
+		for _, i := range idx {
+			sub = append(sub, args[i*2], args[i*2+1])
+		}
+		subs = append(subs, SubRequest{Slot: slot, Multi: sub})
+	}
+	merge := func(_ []SubRequest, reply []*redis.Resp) (*redis.Resp, error) {
+		if !isSetNx {
+			return redis.NewString([]byte("OK")), nil
+		}
+		for _, r := range reply {
+			if redis.ParseInt(r.Value) == 0 {
+				return redis.NewInt(0), nil
+			}
+		}
+		return redis.NewInt(1), nil
+	}
+	return subs, merge, nil
+}
+
+// splitDestOp handles SUNIONSTORE/SDIFFSTORE/SINTERSTORE: only safe to
+// split when the destination and every source key share the same hash tag,
+// since the set operation itself still has to run on a single backend.  In
+// that case there's nothing to scatter; splitRequest returns a nil split so
+// the caller falls back to ordinary single-slot dispatch.
+func splitDestOp(multi []*redis.Resp) ([]SubRequest, MergeFn, error) {
+	args := multi[1:]
+	if len(args) < 2 {
+		return nil, nil, errors.Trace(ErrBadMultiBulk)
+	}
+	keys := make([][]byte, len(args))
+	for i, r := range args {
+		keys[i] = r.Value
+	}
+	groups := keySlots(keys)
+	if len(groups) <= 1 {
+		return nil, nil, nil
+	}
+	return nil, nil, errors.Trace(ErrCrossSlot)
+}
+
+func opIsWrite(multi []*redis.Resp) bool {
+	opstr, flag, err := getOpInfo(multi)
+	_ = opstr
+	return err == nil && (flag&FlagWrite) != 0
+}
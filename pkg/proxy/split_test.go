@@ -0,0 +1,253 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+)
+
+// fixedByteHasher routes a key to the slot named by its first byte mod n,
+// so tests can force keys into however many distinct slots they need
+// instead of hoping real key strings collide the right way under CRC32.
+type fixedByteHasher struct{ n int }
+
+func (h fixedByteHasher) Slot(key []byte) int {
+	return int(key[0]) % h.n
+}
+
+func withHasher(t *testing.T, h SlotHasher) {
+	t.Helper()
+	prev := activeHasher
+	activeHasher = h
+	t.Cleanup(func() { activeHasher = prev })
+}
+
+func bulk(s string) *redis.Resp {
+	return redis.NewBulkBytes([]byte(s))
+}
+
+func multiOf(args ...string) []*redis.Resp {
+	multi := make([]*redis.Resp, len(args))
+	for i, a := range args {
+		multi[i] = bulk(a)
+	}
+	return multi
+}
+
+// recordingAuthz records every key it's asked to authorize, so tests can
+// check DispatchSplit ran the check against every key a split command
+// touches rather than just the one getHashKey would have picked.
+type recordingAuthz struct {
+	keys [][]byte
+	deny map[string]bool
+}
+
+func (a *recordingAuthz) Authorize(user, opstr string, flag OpFlag, cat OpCategory, key []byte) error {
+	a.keys = append(a.keys, append([]byte(nil), key...))
+	if a.deny[string(key)] {
+		return ErrNotAuthorized
+	}
+	return nil
+}
+
+func TestDispatchSplitAuthorizesEveryKey(t *testing.T) {
+	withHasher(t, fixedByteHasher{n: 4})
+	prevSplit := SplitMultiKey
+	SplitMultiKey = true
+	defer func() { SplitMultiKey = prevSplit }()
+
+	authz := &recordingAuthz{deny: map[string]bool{"Bkey": true}}
+	multi := multiOf("MGET", "Akey", "Bkey", "Ckey")
+	cfg := DispatchConfig{
+		Authz: authz,
+		Send: func(slot int, multi []*redis.Resp) (*redis.Resp, error) {
+			t.Fatal("Send must not run once any key fails authorization")
+			return nil, nil
+		},
+	}
+	_, _, err := DispatchSplit(multi, cfg)
+	if err == nil {
+		t.Fatal("expected authorization error for Bkey, got nil")
+	}
+	if len(authz.keys) == 0 {
+		t.Fatal("Authorize was never called")
+	}
+	var sawB bool
+	for _, k := range authz.keys {
+		if bytes.Equal(k, []byte("Bkey")) {
+			sawB = true
+		}
+	}
+	if !sawB {
+		t.Error("Authorize was never called for Bkey, only the routing key was checked")
+	}
+}
+
+func TestDispatchSplitRedirectsAtomically(t *testing.T) {
+	withHasher(t, fixedByteHasher{n: 4})
+	prevSplit, prevRedirect := SplitMultiKey, ClusterRedirect
+	SplitMultiKey, ClusterRedirect = true, true
+	defer func() { SplitMultiKey, ClusterRedirect = prevSplit, prevRedirect }()
+
+	prevTopology := clusterTopology
+	defer SetClusterTopology(prevTopology)
+	SetClusterTopology(fakeTopology{
+		{Begin: 0, End: 1, Master: "127.0.0.1:7001"},
+		{Begin: 2, End: 3, Master: "127.0.0.1:7002"},
+	})
+
+	var sent []int
+	// Akey -> slot 1 (owned by localAddr), Bkey -> slot 2 (owned remotely):
+	// the 2nd fragment should redirect, and the 1st must never have been
+	// sent, since a split command must run in full or not at all.
+	multi := multiOf("MGET", "Akey", "Bkey")
+	cfg := DispatchConfig{
+		LocalAddr: "127.0.0.1:7001",
+		Send: func(slot int, sub []*redis.Resp) (*redis.Resp, error) {
+			sent = append(sent, slot)
+			return redis.NewArray(nil), nil
+		},
+	}
+	reply, ok, err := DispatchSplit(multi, cfg)
+	if err != nil {
+		t.Fatalf("DispatchSplit: %v", err)
+	}
+	if !ok {
+		t.Fatal("expected ok=true (command was split)")
+	}
+	if len(sent) != 0 {
+		t.Fatalf("expected no fragment to be sent before the redirect, got %v", sent)
+	}
+	if !bytes.HasPrefix(reply.Value, []byte("MOVED")) {
+		t.Errorf("reply = %q, want a MOVED error", reply.Value)
+	}
+}
+
+type fakeTopology []ClusterSlot
+
+func (f fakeTopology) ClusterSlots() []ClusterSlot { return f }
+
+func TestSplitGatherRoundTrip(t *testing.T) {
+	withHasher(t, fixedByteHasher{n: 4})
+
+	// first bytes 'D','A','B','C' land in slots 0,1,2,3 respectively.
+	multi := multiOf("MGET", "Dkey", "Akey", "Bkey", "Ckey")
+	subs, merge, err := splitGather(multi)
+	if err != nil {
+		t.Fatalf("splitGather: %v", err)
+	}
+	if len(subs) != 4 {
+		t.Fatalf("expected 4 sub-requests, got %d", len(subs))
+	}
+
+	replies := make([]*redis.Resp, len(subs))
+	for i, sub := range subs {
+		vals := make([]*redis.Resp, len(sub.Multi)-1)
+		for j, keyResp := range sub.Multi[1:] {
+			vals[j] = bulk("val-" + string(keyResp.Value))
+		}
+		replies[i] = redis.NewArray(vals)
+	}
+
+	out, err := merge(subs, replies)
+	if err != nil {
+		t.Fatalf("merge: %v", err)
+	}
+	want := []string{"val-Dkey", "val-Akey", "val-Bkey", "val-Ckey"}
+	if len(out.Array) != len(want) {
+		t.Fatalf("expected %d replies, got %d", len(want), len(out.Array))
+	}
+	for i, w := range want {
+		if !bytes.Equal(out.Array[i].Value, []byte(w)) {
+			t.Errorf("reply[%d] = %q, want %q", i, out.Array[i].Value, w)
+		}
+	}
+}
+
+func TestSplitCountRoundTrip(t *testing.T) {
+	withHasher(t, fixedByteHasher{n: 4})
+	prevAllow := AllowCrossSlotWrite
+	AllowCrossSlotWrite = true
+	defer func() { AllowCrossSlotWrite = prevAllow }()
+
+	multi := multiOf("DEL", "Akey", "Bkey", "Ckey")
+	subs, merge, err := splitCount(multi)
+	if err != nil {
+		t.Fatalf("splitCount: %v", err)
+	}
+	if len(subs) != 3 {
+		t.Fatalf("expected 3 sub-requests, got %d", len(subs))
+	}
+
+	replies := make([]*redis.Resp, len(subs))
+	for i := range subs {
+		replies[i] = redis.NewInt(1)
+	}
+	out, err := merge(subs, replies)
+	if err != nil {
+		t.Fatalf("merge: %v", err)
+	}
+	if got := redis.ParseInt(out.Value); got != 3 {
+		t.Errorf("summed DEL count = %d, want 3", got)
+	}
+}
+
+func TestSplitCountCrossSlotRejectedByDefault(t *testing.T) {
+	withHasher(t, fixedByteHasher{n: 4})
+	// AllowCrossSlotWrite defaults to false; DEL is a write op.
+	multi := multiOf("DEL", "Akey", "Bkey")
+	if _, _, err := splitCount(multi); err == nil {
+		t.Fatal("expected ErrCrossSlot, got nil")
+	}
+}
+
+func TestSplitStoreRoundTrip(t *testing.T) {
+	withHasher(t, fixedByteHasher{n: 4})
+	prevAllow := AllowCrossSlotWrite
+	AllowCrossSlotWrite = true
+	defer func() { AllowCrossSlotWrite = prevAllow }()
+
+	multi := multiOf("MSET", "Akey", "1", "Bkey", "2")
+	subs, merge, err := splitStore(multi)
+	if err != nil {
+		t.Fatalf("splitStore: %v", err)
+	}
+	if len(subs) != 2 {
+		t.Fatalf("expected 2 sub-requests, got %d", len(subs))
+	}
+
+	replies := make([]*redis.Resp, len(subs))
+	for i := range subs {
+		replies[i] = redis.NewString([]byte("OK"))
+	}
+	out, err := merge(subs, replies)
+	if err != nil {
+		t.Fatalf("merge: %v", err)
+	}
+	if !bytes.Equal(out.Value, []byte("OK")) {
+		t.Errorf("MSET reply = %q, want OK", out.Value)
+	}
+}
+
+func TestSplitStoreMSETNXCrossSlotNeedsOwnFlag(t *testing.T) {
+	withHasher(t, fixedByteHasher{n: 4})
+	prevWrite, prevSetNx := AllowCrossSlotWrite, AllowCrossSlotMSETNX
+	AllowCrossSlotWrite, AllowCrossSlotMSETNX = true, false
+	defer func() { AllowCrossSlotWrite, AllowCrossSlotMSETNX = prevWrite, prevSetNx }()
+
+	// AllowCrossSlotWrite alone must not be enough to split MSETNX: its
+	// atomicity guarantee can't survive being split across shards.
+	multi := multiOf("MSETNX", "Akey", "1", "Bkey", "2")
+	if _, _, err := splitStore(multi); err == nil {
+		t.Fatal("expected ErrCrossSlot for cross-slot MSETNX without AllowCrossSlotMSETNX, got nil")
+	}
+
+	AllowCrossSlotMSETNX = true
+	if _, _, err := splitStore(multi); err != nil {
+		t.Fatalf("expected cross-slot MSETNX to split once AllowCrossSlotMSETNX is set: %v", err)
+	}
+}
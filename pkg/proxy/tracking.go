@@ -0,0 +1,224 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/errors"
+)
+
+// Subscriber is the client-facing connection side of client-side caching:
+// whatever holds the socket a CLIENT TRACKING client is on, so the tracker
+// can push it invalidation messages without depending on the concrete
+// connection type.
+type Subscriber interface {
+	Push(resp *redis.Resp) error
+}
+
+// TrackingMode is how a connection asked to be tracked via CLIENT TRACKING.
+type TrackingMode int
+
+const (
+	TrackingOff TrackingMode = iota
+	TrackingDefault
+	TrackingBCAST
+)
+
+// ClientTracking is one connection's CLIENT TRACKING state.  RedirectID is
+// the connection id a REDIRECT clause named; it's resolved to a Subscriber
+// (stored in Redirect) by the connection table the router keeps, since
+// ParseClientTracking only sees the raw CLIENT TRACKING arguments, not live
+// connections.
+type ClientTracking struct {
+	Mode       TrackingMode
+	RedirectID int
+	Redirect   Subscriber
+	Prefixes   [][]byte
+}
+
+// Tracker fans out write invalidations to the clients caching the keys
+// they touch.  Default-mode subscriptions are per-key and one-shot, same
+// as Redis: once a tracked key is invalidated the client has to re-read
+// and re-register it.  BCAST subscriptions stay registered and are
+// matched against every write by prefix.
+type Tracker struct {
+	mu     sync.Mutex
+	bySlot map[int]map[string]map[Subscriber]bool
+	bcast  map[Subscriber][][]byte
+}
+
+// NewTracker creates an empty Tracker; the proxy keeps one shared instance
+// and passes it to every connection's CLIENT TRACKING handler.
+func NewTracker() *Tracker {
+	return &Tracker{
+		bySlot: make(map[int]map[string]map[Subscriber]bool),
+		bcast:  make(map[Subscriber][][]byte),
+	}
+}
+
+// Track registers sub's interest in key, to be invalidated the next time
+// key is written.
+func (t *Tracker) Track(key []byte, sub Subscriber) {
+	slot := hashSlot(key)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	byKey, ok := t.bySlot[slot]
+	if !ok {
+		byKey = make(map[string]map[Subscriber]bool)
+		t.bySlot[slot] = byKey
+	}
+	subs, ok := byKey[string(key)]
+	if !ok {
+		subs = make(map[Subscriber]bool)
+		byKey[string(key)] = subs
+	}
+	subs[sub] = true
+}
+
+// TrackBCAST registers sub for invalidations on every write whose key
+// starts with prefix (an empty prefix matches every key).
+func (t *Tracker) TrackBCAST(prefix []byte, sub Subscriber) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.bcast[sub] = append(t.bcast[sub], prefix)
+}
+
+// Untrack drops every subscription sub holds, called when a connection
+// disconnects or sends CLIENT TRACKING OFF.
+func (t *Tracker) Untrack(sub Subscriber) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.bcast, sub)
+	for _, byKey := range t.bySlot {
+		for key, subs := range byKey {
+			delete(subs, sub)
+			if len(subs) == 0 {
+				delete(byKey, key)
+			}
+		}
+	}
+}
+
+// Invalidate notifies every subscriber tracking key that it changed.  Its
+// only caller is DispatchSplit, for the keys each fragment of a split MSET,
+// MSETNX, DEL or UNLINK writes; writes dispatched to a single slot don't
+// call it.
+func (t *Tracker) Invalidate(key []byte) {
+	slot := hashSlot(key)
+	t.mu.Lock()
+	var targets []Subscriber
+	if byKey, ok := t.bySlot[slot]; ok {
+		if subs, ok := byKey[string(key)]; ok {
+			for sub := range subs {
+				targets = append(targets, sub)
+			}
+			delete(byKey, string(key))
+		}
+	}
+	for sub, prefixes := range t.bcast {
+		for _, p := range prefixes {
+			if bytes.HasPrefix(key, p) {
+				targets = append(targets, sub)
+				break
+			}
+		}
+	}
+	t.mu.Unlock()
+
+	push := invalidatePush(key)
+	for _, sub := range targets {
+		sub.Push(push)
+	}
+}
+
+// invalidatePush builds the two-element "invalidate" message pushed to a
+// tracking client.  It's encoded as a plain array rather than a real RESP3
+// push frame (type '>') because that encoder isn't part of this change;
+// it still deserializes as a valid out-of-band message to any client that
+// reads greedily, which is the same accommodation Redis itself documents
+// for RESP2 tracking clients in REDIRECT mode.
+func invalidatePush(key []byte) *redis.Resp {
+	return redis.NewArray([]*redis.Resp{
+		redis.NewBulkBytes([]byte("invalidate")),
+		redis.NewArray([]*redis.Resp{redis.NewBulkBytes(key)}),
+	})
+}
+
+var ErrBadClientTracking = errors.New("bad CLIENT TRACKING syntax")
+
+// ParseClientTracking parses the arguments of CLIENT TRACKING ON|OFF
+// [REDIRECT id] [BCAST] [PREFIX p ...], e.g. the tail of a CLIENT TRACKING
+// ON BCAST PREFIX foo command with "ON" through "foo" as args.
+func ParseClientTracking(args []*redis.Resp) (*ClientTracking, error) {
+	if len(args) == 0 {
+		return nil, errors.Trace(ErrBadClientTracking)
+	}
+	ct := &ClientTracking{}
+	switch strings.ToUpper(string(args[0].Value)) {
+	case "OFF":
+		return ct, nil
+	case "ON":
+		ct.Mode = TrackingDefault
+	default:
+		return nil, errors.Trace(ErrBadClientTracking)
+	}
+	for i := 1; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i].Value)) {
+		case "BCAST":
+			ct.Mode = TrackingBCAST
+		case "REDIRECT":
+			if i+1 >= len(args) {
+				return nil, errors.Trace(ErrBadClientTracking)
+			}
+			i++
+			id, err := strconv.Atoi(string(args[i].Value))
+			if err != nil {
+				return nil, errors.Trace(ErrBadClientTracking)
+			}
+			ct.RedirectID = id
+		case "PREFIX":
+			if i+1 >= len(args) {
+				return nil, errors.Trace(ErrBadClientTracking)
+			}
+			i++
+			ct.Prefixes = append(ct.Prefixes, args[i].Value)
+		default:
+			return nil, errors.Trace(ErrBadClientTracking)
+		}
+	}
+	return ct, nil
+}
+
+// HelloReply answers HELLO [protover [AUTH user pass] [SETNAME name]] with
+// the server/proto info RESP expects, after validating protover is 2 or 3
+// (the only versions the proxy's codec speaks).  The reply is always
+// encoded as a flat array of alternating field/value pairs: RESP3's map
+// type (encoder '%') isn't part of this change, and a RESP2-shaped array
+// is exactly what real Redis sends a HELLO 2 client, so proto-2 callers
+// see nothing unusual; proto-3 callers get the same bytes until the map
+// encoder lands.
+func HelloReply(multi []*redis.Resp, proxyName string) (*redis.Resp, error) {
+	proto := 2
+	if len(multi) > 1 {
+		p, err := strconv.Atoi(string(multi[1].Value))
+		if err != nil || (p != 2 && p != 3) {
+			return nil, errors.Errorf("NOPROTO unsupported protocol version")
+		}
+		proto = p
+	}
+	fields := []*redis.Resp{
+		redis.NewBulkBytes([]byte("server")), redis.NewBulkBytes([]byte("codis")),
+		redis.NewBulkBytes([]byte("proxy")), redis.NewBulkBytes([]byte(proxyName)),
+		redis.NewBulkBytes([]byte("proto")), redis.NewInt(int64(proto)),
+		redis.NewBulkBytes([]byte("mode")), redis.NewBulkBytes([]byte("standalone")),
+		redis.NewBulkBytes([]byte("role")), redis.NewBulkBytes([]byte("master")),
+		redis.NewBulkBytes([]byte("modules")), redis.NewArray(nil),
+	}
+	return redis.NewArray(fields), nil
+}